@@ -1,30 +1,91 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+const (
+	defaultGridWorkers         = 10
+	defaultHTTPTimeout         = 10 * time.Second
+	defaultScrapeTimeout       = 30 * time.Second
+	defaultMaxIdleConnsPerHost = 5
+	maxRequestRetries          = 3
+	retryBaseDelay             = 100 * time.Millisecond
+)
+
 var (
-	TORCH_HOST    = os.Getenv("TORCH_HOST")
-	TORCH_PORT    = os.Getenv("TORCH_PORT")
-	TORCH_PASS    = os.Getenv("TORCH_PASS")
-	INTERVAL      = os.Getenv("INTERVAL")
-	timerInterval = time.Minute
+	TORCH_HOST     = os.Getenv("TORCH_HOST")
+	TORCH_PORT     = os.Getenv("TORCH_PORT")
+	TORCH_PASS     = os.Getenv("TORCH_PASS")
+	GRID_WORKERS   = os.Getenv("GRID_WORKERS")
+	LOG_LEVEL      = os.Getenv("LOG_LEVEL")
+	LOG_FORMAT     = os.Getenv("LOG_FORMAT")
+	HTTP_TIMEOUT   = os.Getenv("HTTP_TIMEOUT")
+	SCRAPE_TIMEOUT = os.Getenv("SCRAPE_TIMEOUT")
+
+	httpClient = &http.Client{
+		Timeout: parseDurationEnv(HTTP_TIMEOUT, defaultHTTPTimeout),
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: defaultMaxIdleConnsPerHost,
+		},
+	}
 )
 
+// parseDurationEnv parses a duration from an env var value, falling back to
+// def if the value is empty or fails to parse.
+func parseDurationEnv(value string, def time.Duration) time.Duration {
+	if value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+// initLogger configures the default slog logger from LOG_LEVEL and
+// LOG_FORMAT so operators running under Docker/Kubernetes can ship JSON
+// logs to Loki or Elasticsearch without regex-parsing free-form output.
+func initLogger() {
+	level := slog.LevelInfo
+	switch strings.ToLower(LOG_LEVEL) {
+	case "debug":
+		level = slog.LevelDebug
+	case "warn":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if strings.ToLower(LOG_FORMAT) == "text" {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	} else {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	}
+
+	slog.SetDefault(slog.New(handler))
+}
+
 type StatusEnum int
 
 const (
@@ -52,78 +113,294 @@ type worldStatus struct {
 	SizeKb int    `json:"sizeKb"`
 }
 
-var (
-	metricSimSpeed      = prometheus.NewGauge(prometheus.GaugeOpts{Name: "spaceengineers_sim_speed"})
-	metricPlayerCount   = prometheus.NewGauge(prometheus.GaugeOpts{Name: "spaceengineers_player_count"})
-	metricGameReady     = prometheus.NewGauge(prometheus.GaugeOpts{Name: "spaceengineers_game_ready"})
-	metricUptime        = prometheus.NewGauge(prometheus.GaugeOpts{Name: "spaceengineers_uptime"})
-	metricGridCount     = prometheus.NewGauge(prometheus.GaugeOpts{Name: "spaceengineers_grid_count"})
-	metricBannedCount   = prometheus.NewGauge(prometheus.GaugeOpts{Name: "spaceengineers_banned_player_count"})
-	metricWorldSize     = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "spaceengineers_world_size"}, []string{"world"})
-	metricPlayersOnline = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "spaceengineers_players"}, []string{"name", "steamID"})
-)
+type gridDetail struct {
+	Name         string  `json:"name"`
+	OwnerSteamID int64   `json:"ownerSteamId"`
+	BlocksCount  int     `json:"blocksCount"`
+	PCU          int     `json:"pcu"`
+	Mass         float64 `json:"mass"`
+	IsPowered    bool    `json:"isPowered"`
+}
+
+// Collector implements prometheus.Collector, fetching metrics from Torch
+// on-demand whenever Prometheus scrapes /metrics, mirroring the pattern
+// used by node_exporter/blackbox_exporter rather than polling on a timer.
+type Collector struct {
+	upDesc               *prometheus.Desc
+	scrapeDurationDesc   *prometheus.Desc
+	collectorSuccessDesc *prometheus.Desc
+
+	simSpeedDesc      *prometheus.Desc
+	playerCountDesc   *prometheus.Desc
+	gameReadyDesc     *prometheus.Desc
+	uptimeDesc        *prometheus.Desc
+	gridCountDesc     *prometheus.Desc
+	bannedCountDesc   *prometheus.Desc
+	worldSizeDesc     *prometheus.Desc
+	playersOnlineDesc *prometheus.Desc
+
+	// sessionSeconds, loginsTotal, and logoutsTotal are cumulative across
+	// scrapes, so unlike the const metrics above they're kept as real
+	// metric objects that accumulate their own state.
+	sessionSeconds prometheus.Histogram
+	loginsTotal    *prometheus.CounterVec
+	logoutsTotal   *prometheus.CounterVec
+
+	// playersOnline tracks when each currently-connected player joined so
+	// we can report how long they've been online between scrapes, and
+	// detect logouts when a player drops out of the list.
+	playersOnline map[int64]*playerSession
+
+	// gridBlocks, gridPCU, gridMass, and gridPowered are reset and
+	// repopulated every scrape, the same way playersOnlineDesc used to be
+	// as a GaugeVec, so grids that get deleted drop out of the series.
+	gridBlocks  *prometheus.GaugeVec
+	gridPCU     *prometheus.GaugeVec
+	gridMass    *prometheus.GaugeVec
+	gridPowered *prometheus.GaugeVec
+
+	// gridWorkers bounds how many /api/v1/grids/{id} requests run
+	// concurrently so a server with hundreds of grids doesn't blow past
+	// the scrape timeout.
+	gridWorkers int
+
+	// scrapeTimeout bounds the context passed to every collector on a given
+	// scrape, so a hung request to Torch can't wedge the whole /metrics
+	// handler indefinitely.
+	scrapeTimeout time.Duration
+
+	// mu serializes Collect(), since promhttp's registry can invoke it
+	// concurrently from overlapping scrapes (e.g. two Prometheus instances,
+	// or a late scrape overlapping the next one), and the mutable state
+	// above (playersOnline in particular) isn't safe for concurrent access.
+	mu sync.Mutex
+}
 
-func doServerStatus() error {
+type playerSession struct {
+	joined  time.Time
+	name    string
+	steamID string
+}
+
+func NewCollector(gridWorkers int) *Collector {
+	return &Collector{
+		upDesc:               prometheus.NewDesc("spaceengineers_up", "Whether the last scrape of Torch succeeded", nil, nil),
+		scrapeDurationDesc:   prometheus.NewDesc("spaceengineers_scrape_duration_seconds", "Time taken to scrape all Torch collectors", nil, nil),
+		collectorSuccessDesc: prometheus.NewDesc("spaceengineers_collector_success", "Whether a given collector succeeded during the last scrape", []string{"collector"}, nil),
+
+		simSpeedDesc:      prometheus.NewDesc("spaceengineers_sim_speed", "Current simulation speed", nil, nil),
+		playerCountDesc:   prometheus.NewDesc("spaceengineers_player_count", "Number of members on the server", nil, nil),
+		gameReadyDesc:     prometheus.NewDesc("spaceengineers_game_ready", "Server status enum (0=stopped, 1=starting, 2=running, 3=crashed)", nil, nil),
+		uptimeDesc:        prometheus.NewDesc("spaceengineers_uptime", "Server uptime in seconds", nil, nil),
+		gridCountDesc:     prometheus.NewDesc("spaceengineers_grid_count", "Number of grids on the server", nil, nil),
+		bannedCountDesc:   prometheus.NewDesc("spaceengineers_banned_player_count", "Number of banned players", nil, nil),
+		worldSizeDesc:     prometheus.NewDesc("spaceengineers_world_size", "World size in kilobytes", []string{"world"}, nil),
+		playersOnlineDesc: prometheus.NewDesc("spaceengineers_players", "Seconds the player has been online this session", []string{"name", "steamID"}, nil),
+
+		sessionSeconds: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "spaceengineers_player_session_seconds",
+			Help:    "Distribution of player session lengths in seconds, observed when a player leaves",
+			Buckets: prometheus.ExponentialBuckets(60, 2, 12),
+		}),
+		loginsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "spaceengineers_player_logins_total",
+			Help: "Total number of times a player has logged in",
+		}, []string{"name", "steamID"}),
+		logoutsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "spaceengineers_player_logouts_total",
+			Help: "Total number of times a player has logged out",
+		}, []string{"name", "steamID"}),
+
+		playersOnline: map[int64]*playerSession{},
+
+		gridBlocks: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "spaceengineers_grid_blocks",
+			Help: "Number of blocks in the grid",
+		}, []string{"name", "ownerSteamID"}),
+		gridPCU: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "spaceengineers_grid_pcu",
+			Help: "PCU used by the grid",
+		}, []string{"name", "ownerSteamID"}),
+		gridMass: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "spaceengineers_grid_mass_kg",
+			Help: "Mass of the grid in kilograms",
+		}, []string{"name", "ownerSteamID"}),
+		gridPowered: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "spaceengineers_grid_is_powered",
+			Help: "Whether the grid is powered",
+		}, []string{"name", "ownerSteamID"}),
+
+		gridWorkers:   gridWorkers,
+		scrapeTimeout: parseDurationEnv(SCRAPE_TIMEOUT, defaultScrapeTimeout),
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.upDesc
+	ch <- c.scrapeDurationDesc
+	ch <- c.collectorSuccessDesc
+	ch <- c.simSpeedDesc
+	ch <- c.playerCountDesc
+	ch <- c.gameReadyDesc
+	ch <- c.uptimeDesc
+	ch <- c.gridCountDesc
+	ch <- c.bannedCountDesc
+	ch <- c.worldSizeDesc
+	ch <- c.playersOnlineDesc
+	c.sessionSeconds.Describe(ch)
+	c.loginsTotal.Describe(ch)
+	c.logoutsTotal.Describe(ch)
+	c.gridBlocks.Describe(ch)
+	c.gridPCU.Describe(ch)
+	c.gridMass.Describe(ch)
+	c.gridPowered.Describe(ch)
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	start := time.Now()
+	up := 1.0
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.scrapeTimeout)
+	defer cancel()
+
+	collectors := []struct {
+		name string
+		fn   func(context.Context, chan<- prometheus.Metric) error
+	}{
+		{"server_status", c.collectServerStatus},
+		{"grids", c.collectGrids},
+		{"banned_count", c.collectBannedCount},
+		{"worlds", c.collectWorlds},
+		{"players_online", c.collectPlayersOnline},
+	}
+
+	for _, collector := range collectors {
+		success := 1.0
+		if err := collector.fn(ctx, ch); err != nil {
+			slog.Error("collector failed", "collector", collector.name, "error", err)
+			up = 0
+			success = 0
+		}
+		ch <- prometheus.MustNewConstMetric(c.collectorSuccessDesc, prometheus.GaugeValue, success, collector.name)
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.upDesc, prometheus.GaugeValue, up)
+	ch <- prometheus.MustNewConstMetric(c.scrapeDurationDesc, prometheus.GaugeValue, time.Since(start).Seconds())
+}
+
+func (c *Collector) collectServerStatus(ctx context.Context, ch chan<- prometheus.Metric) error {
 	var status *serverStatus
-	err := makeRequest("/api/v1/server/status", &status)
+	err := makeRequest(ctx, "/api/v1/server/status", &status)
 	if err != nil {
 		return err
 	}
 
-	metricSimSpeed.Set(status.SimSpeed)
-	metricPlayerCount.Set(float64(status.MemberCount))
-	metricGameReady.Set(float64(status.Status))
-	metricUptime.Set(status.Uptime.Seconds())
+	ch <- prometheus.MustNewConstMetric(c.simSpeedDesc, prometheus.GaugeValue, status.SimSpeed)
+	ch <- prometheus.MustNewConstMetric(c.playerCountDesc, prometheus.GaugeValue, float64(status.MemberCount))
+	ch <- prometheus.MustNewConstMetric(c.gameReadyDesc, prometheus.GaugeValue, float64(status.Status))
+	ch <- prometheus.MustNewConstMetric(c.uptimeDesc, prometheus.GaugeValue, status.Uptime.Seconds())
 	return nil
 }
 
-func doGetGridCount() error {
+func (c *Collector) collectGrids(ctx context.Context, ch chan<- prometheus.Metric) error {
 	var gridIds []int64
-	err := makeRequest("/api/v1/grids", &gridIds)
+	err := makeRequest(ctx, "/api/v1/grids", &gridIds)
 	if err != nil {
 		return err
 	}
 
-	metricGridCount.Set(float64(len(gridIds)))
-	return nil
+	ch <- prometheus.MustNewConstMetric(c.gridCountDesc, prometheus.GaugeValue, float64(len(gridIds)))
+
+	c.gridBlocks.Reset()
+	c.gridPCU.Reset()
+	c.gridMass.Reset()
+	c.gridPowered.Reset()
+
+	sem := make(chan struct{}, c.gridWorkers)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+
+	for _, id := range gridIds {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(id int64) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var grid *gridDetail
+			if err := makeRequest(ctx, fmt.Sprintf("/api/v1/grids/%d", id), &grid); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				return
+			}
+
+			owner := strconv.FormatInt(grid.OwnerSteamID, 10)
+			c.gridBlocks.WithLabelValues(grid.Name, owner).Set(float64(grid.BlocksCount))
+			c.gridPCU.WithLabelValues(grid.Name, owner).Set(float64(grid.PCU))
+			c.gridMass.WithLabelValues(grid.Name, owner).Set(grid.Mass)
+			c.gridPowered.WithLabelValues(grid.Name, owner).Set(boolToFloat(grid.IsPowered))
+		}(id)
+	}
+
+	wg.Wait()
+
+	c.gridBlocks.Collect(ch)
+	c.gridPCU.Collect(ch)
+	c.gridMass.Collect(ch)
+	c.gridPowered.Collect(ch)
+
+	return firstErr
 }
 
-func doGetBannedCount() error {
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (c *Collector) collectBannedCount(ctx context.Context, ch chan<- prometheus.Metric) error {
 	var playerIds []int64
-	err := makeRequest("/api/v1/players/banned", &playerIds)
+	err := makeRequest(ctx, "/api/v1/players/banned", &playerIds)
 	if err != nil {
 		return err
 	}
 
-	metricBannedCount.Set(float64(len(playerIds)))
+	ch <- prometheus.MustNewConstMetric(c.bannedCountDesc, prometheus.GaugeValue, float64(len(playerIds)))
 	return nil
 }
 
-func doGetWorlds() error {
+func (c *Collector) collectWorlds(ctx context.Context, ch chan<- prometheus.Metric) error {
 	var worldIds []string
-	err := makeRequest("/api/v1/worlds", &worldIds)
+	err := makeRequest(ctx, "/api/v1/worlds", &worldIds)
 	if err != nil {
 		return err
 	}
 
 	for _, id := range worldIds {
 		var world *worldStatus
-		err = makeRequest(fmt.Sprintf("/api/v1/worlds/%s", id), &world)
+		err = makeRequest(ctx, fmt.Sprintf("/api/v1/worlds/%s", id), &world)
 		if err != nil {
 			return err
 		}
 
-		metricWorldSize.WithLabelValues(world.Name).Set(float64(world.SizeKb))
+		ch <- prometheus.MustNewConstMetric(c.worldSizeDesc, prometheus.GaugeValue, float64(world.SizeKb), world.Name)
 	}
 
 	return nil
 }
 
-var playersOnline = map[int64]time.Time{}
-
-func doGetPlayersOnline() error {
+func (c *Collector) collectPlayersOnline(ctx context.Context, ch chan<- prometheus.Metric) error {
 	var players []*playerStatus
-	err := makeRequest("/api/v1/players", &players)
+	err := makeRequest(ctx, "/api/v1/players", &players)
 	if err != nil {
 		return err
 	}
@@ -131,120 +408,133 @@ func doGetPlayersOnline() error {
 	// generate now just once to save time
 	now := time.Now()
 
-	// reset metrics the easiet way to reset ones that aren't on anymore
-	metricPlayersOnline.Reset()
-
 	// build list of players we have to filter ones to remove from the map
 	existingIds := map[int64]bool{}
-	for k := range playersOnline {
+	for k := range c.playersOnline {
 		existingIds[k] = true
 	}
 
 	// loop for stats
 	for _, p := range players {
-		joined, exists := playersOnline[p.ClientID]
+		steamID := strconv.FormatInt(p.ClientID, 10)
+		session, exists := c.playersOnline[p.ClientID]
 		if !exists {
 			// new user, add to map
-			playersOnline[p.ClientID] = now
-			joined = now
+			session = &playerSession{joined: now, name: p.Name, steamID: steamID}
+			c.playersOnline[p.ClientID] = session
+			c.loginsTotal.WithLabelValues(p.Name, steamID).Inc()
 		} else {
 			delete(existingIds, p.ClientID)
 		}
 
-		metricPlayersOnline.WithLabelValues(p.Name, strconv.FormatInt(p.ClientID, 10)).Set(math.Floor(now.Sub(joined).Seconds()))
+		ch <- prometheus.MustNewConstMetric(c.playersOnlineDesc, prometheus.GaugeValue, math.Floor(now.Sub(session.joined).Seconds()), p.Name, steamID)
 	}
 
-	// any keys remaining in existingIds need to be removed from playersOnline
+	// any keys remaining in existingIds dropped out of the players list
+	// since the last scrape, so they've logged out
 	for k := range existingIds {
-		delete(playersOnline, k)
-	}
-
-	return nil
-}
-
-var metrics []func() error = []func() error{
-	doServerStatus,
-	doGetGridCount,
-	doGetBannedCount,
-	doGetWorlds,
-	doGetPlayersOnline,
-}
-
-func metricsLoop() {
-	log.Printf("poll metrics every %s", timerInterval.String())
-	// loop all metrics on startup
-	log.Println("processing metrics")
-	for _, f := range metrics {
-		if err := f(); err != nil {
-			log.Printf("error processing metrics: %v", err)
-		}
+		session := c.playersOnline[k]
+		c.sessionSeconds.Observe(now.Sub(session.joined).Seconds())
+		c.logoutsTotal.WithLabelValues(session.name, session.steamID).Inc()
+		delete(c.playersOnline, k)
 	}
 
-	ticker := time.NewTicker(timerInterval)
-	defer ticker.Stop()
-
-	// loop on the ticker collecting metrics
-	for range ticker.C {
-		log.Println("processing metrics")
+	c.sessionSeconds.Collect(ch)
+	c.loginsTotal.Collect(ch)
+	c.logoutsTotal.Collect(ch)
 
-		for _, f := range metrics {
-			if err := f(); err != nil {
-				log.Printf("error processing metrics: %v", err)
-			}
-		}
-	}
+	return nil
 }
 
 func main() {
+	initLogger()
+
 	if TORCH_HOST == "" || TORCH_PORT == "" || TORCH_PASS == "" {
-		log.Fatal("Set TORCH_HOST, TORCH_PORT, and TORCH_PASS")
+		slog.Error("Set TORCH_HOST, TORCH_PORT, and TORCH_PASS")
+		os.Exit(1)
 	}
 
-	if INTERVAL != "" {
+	gridWorkers := defaultGridWorkers
+	if GRID_WORKERS != "" {
 		var err error
-		timerInterval, err = time.ParseDuration(INTERVAL)
+		gridWorkers, err = strconv.Atoi(GRID_WORKERS)
 		if err != nil {
-			log.Fatalf("Failed to parse INTERVAL: %v", err)
-			return
+			slog.Error("failed to parse GRID_WORKERS", "error", err)
+			os.Exit(1)
+		}
+		if gridWorkers <= 0 {
+			slog.Error("GRID_WORKERS must be a positive integer", "value", GRID_WORKERS)
+			os.Exit(1)
 		}
 	}
 
-	prometheus.MustRegister(metricSimSpeed)
-	prometheus.MustRegister(metricPlayerCount)
-	prometheus.MustRegister(metricGameReady)
-	prometheus.MustRegister(metricUptime)
-	prometheus.MustRegister(metricGridCount)
-	prometheus.MustRegister(metricBannedCount)
-	prometheus.MustRegister(metricWorldSize)
-	prometheus.MustRegister(metricPlayersOnline)
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(NewCollector(gridWorkers))
 
-	go metricsLoop()
-
-	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
 	http.ListenAndServe(":9090", nil)
 }
 
-func makeRequest(path string, dest any) error {
-	url := url.URL{
+// makeRequest fetches path from Torch and decodes the JSON response into
+// dest, retrying transient connection errors and 5xx responses with a
+// backoff so a single dropped packet doesn't fail the whole scrape. It
+// honors ctx so a caller-imposed scrape timeout can abort an in-flight or
+// queued retry.
+func makeRequest(ctx context.Context, path string, dest any) error {
+	target := fmt.Sprintf("%s:%s", TORCH_HOST, TORCH_PORT)
+	reqURL := url.URL{
 		Scheme: "http",
-		Host:   fmt.Sprintf("%s:%s", TORCH_HOST, TORCH_PORT),
+		Host:   target,
 		Path:   path,
 	}
 
-	req, err := http.NewRequest("GET", url.String(), nil)
-	if err != nil {
-		return err
-	}
-	req.Header.Add("Authorization", "Bearer "+TORCH_PASS)
+	var lastErr error
+	for attempt := 0; attempt <= maxRequestRetries; attempt++ {
+		if attempt > 0 {
+			delay := retryBaseDelay * time.Duration(1<<(attempt-1))
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
+		req, err := http.NewRequestWithContext(ctx, "GET", reqURL.String(), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Add("Authorization", "Bearer "+TORCH_PASS)
+
+		start := time.Now()
+		resp, err := httpClient.Do(req)
+		duration := time.Since(start)
+		if err != nil {
+			lastErr = err
+			slog.Error("request to torch failed", "target", target, "endpoint", path, "attempt", attempt+1, "duration_ms", duration.Milliseconds(), "error", err)
+			continue
+		}
+
+		if resp.StatusCode >= 500 {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("torch returned status %d", resp.StatusCode)
+			slog.Error("request to torch failed", "target", target, "endpoint", path, "attempt", attempt+1, "status_code", resp.StatusCode, "duration_ms", duration.Milliseconds())
+			continue
+		}
+
+		slog.Debug("request to torch completed", "target", target, "endpoint", path, "status_code", resp.StatusCode, "duration_ms", duration.Milliseconds())
+
+		dec := json.NewDecoder(resp.Body)
+		err = dec.Decode(&dest)
+		resp.Body.Close()
+		if err != nil {
+			slog.Error("failed to decode response from torch", "target", target, "endpoint", path, "status_code", resp.StatusCode, "error", err)
+			return err
+		}
+
+		return nil
 	}
-	defer resp.Body.Close()
 
-	dec := json.NewDecoder(resp.Body)
-	return dec.Decode(&dest)
+	return lastErr
 }
 
 type Duration struct {